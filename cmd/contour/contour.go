@@ -134,6 +134,13 @@ func main() {
 	serve.Flag("use-proxy-protocol", "Use PROXY protocol for all listeners").BoolVar(&ch.UseProxyProto)
 	serve.Flag("ingress-class-name", "Contour IngressClass name").StringVar(&reh.IngressClass)
 	serve.Flag("ingressroute-root-namespaces", "Restrict contour to searching these namespaces for root ingress routes").StringVar(&ingressrouteRootNamespaceFlag)
+	duplicatePolicy := serve.Flag("endpoint-duplicate-policy", "How duplicate endpoint addresses are collapsed (max, sum); by default duplicates are kept").Enum(string(contour.DuplicateMax), string(contour.DuplicateSum))
+	reduceWeights := serve.Flag("endpoint-reduce-weights", "Divide each cluster's endpoint weights by their greatest common divisor").Bool()
+	weightPercentages := serve.Flag("endpoint-weight-percentages", "Rescale each cluster's endpoint weights to sum to 100").Bool()
+	sortByWeight := serve.Flag("endpoint-sort-by-weight", "Emit each cluster's endpoints in descending weight order").Bool()
+	logScaleBase := serve.Flag("endpoint-weight-log-base", "Compress resolved endpoint weights to 1 + floor(log_base(weight)); 0 or 1 disables").Default("0").Uint32()
+	podEndpointWeights := serve.Flag("pod-endpoint-weights", "Watch pods and apply their contour.heptio.com/endpoint-weight annotation to their endpoints").Bool()
+	skewWarningFraction := serve.Flag("endpoint-skew-warning-fraction", "Warn when this fraction of a cluster's heaviest endpoints would receive the majority of its traffic; 0 disables").Default("0").Float64()
 
 	args := os.Args[1:]
 	switch kingpin.MustParse(app.Parse(args)) {
@@ -179,8 +186,24 @@ func main() {
 		// Endpoints updates are handled directly by the EndpointsTranslator
 		// due to their high update rate and their orthogonal nature.
 		et := &contour.EndpointsTranslator{
-			FieldLogger: log.WithField("context", "endpointstranslator"),
+			FieldLogger:         log.WithField("context", "endpointstranslator"),
+			DuplicatePolicy:     contour.DuplicatePolicy(*duplicatePolicy),
+			ReduceWeights:       *reduceWeights,
+			WeightPercentages:   *weightPercentages,
+			SkewWarningFraction: *skewWarningFraction,
+			SortByWeight:        *sortByWeight,
+			LogScaleBase:        *logScaleBase,
 		}
+
+		if *podEndpointWeights {
+			pw := &contour.PodWeightCache{
+				FieldLogger: log.WithField("context", "podweightcache"),
+				OnChange:    et.PodWeightChanged,
+			}
+			et.PodWeight = pw.Weight
+			k8s.WatchPods(&g, client, wl, pw)
+		}
+
 		k8s.WatchEndpoints(&g, client, wl, et)
 
 		ch.Metrics = metrics
@@ -28,6 +28,7 @@ const (
 
 	annotationRequestTimeout  = "contour.heptio.com/request-timeout"
 	annotationWebsocketRoutes = "contour.heptio.com/websocket-routes"
+	annotationEndpointWeight  = "contour.heptio.com/endpoint-weight"
 
 	// By default envoy applies a 15 second timeout to all backend requests.
 	// The explicit value 0 turns off the timeout, implying "never time out"
@@ -14,11 +14,16 @@
 package contour
 
 import (
+	"math"
+	"sort"
 	"strings"
+	"sync"
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/gogo/protobuf/types"
+	"github.com/heptio/contour/internal/envoy"
 	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -31,8 +36,100 @@ type EndpointsTranslator struct {
 	logrus.FieldLogger
 	clusterLoadAssignmentCache
 	Cond
+
+	// DuplicatePolicy controls how addresses which appear more than
+	// once in a cluster are collapsed. The zero value, DuplicateKeep,
+	// emits every address as presented by the Endpoints object.
+	DuplicatePolicy DuplicatePolicy
+
+	// NodeWeight, if set, resolves the load balancing weight of each
+	// endpoint address from the name of the node it is scheduled on.
+	// Addresses without a node name keep Envoy's default weight.
+	NodeWeight NodeWeightFunc
+
+	// PodWeight, if set, is consulted before NodeWeight for endpoint
+	// addresses backed by a pod. An override it reports replaces the
+	// node's weight for that endpoint only.
+	PodWeight PodWeightFunc
+
+	// NodeDraining, if set, reports whether the named node is being
+	// drained. Endpoints scheduled on a draining node are marked with
+	// the DRAINING health status so Envoy stops sending them new
+	// connections. Their weight is still resolved via NodeWeight.
+	NodeDraining func(nodeName string) bool
+
+	// LogScaleBase, if greater than 1, compresses resolved pod and node
+	// weights to 1 + floor(log_base(weight)) before they are clamped, so
+	// the heaviest nodes do not dominate.
+	LogScaleBase uint32
+
+	// SplitNodeWeight divides a node's weight evenly among the endpoints
+	// it hosts for each cluster, so the aggregate traffic to a node
+	// follows its weight regardless of how many replicas it runs. Pod
+	// overrides are not divided.
+	SplitNodeWeight bool
+
+	// ReduceWeights divides the endpoint weights of each cluster by their
+	// greatest common divisor, emitting the smallest integer weights that
+	// preserve their ratios.
+	ReduceWeights bool
+
+	// WeightPercentages rescales the endpoint weights of each cluster
+	// so they sum to 100 while preserving their relative shares.
+	WeightPercentages bool
+
+	// SkewWarningFraction, if greater than zero, logs a warning for any
+	// cluster where the heaviest SkewWarningFraction of its endpoints would
+	// receive the majority of its traffic. The warning is advisory only.
+	SkewWarningFraction float64
+
+	// SortByWeight orders the endpoints of each cluster by descending
+	// weight, breaking ties by address. By default endpoints are emitted
+	// in the order presented by the Endpoints object.
+	SortByWeight bool
+
+	// mu serialises recomputation, and guards endpoints.
+	mu sync.Mutex
+
+	// endpoints holds the last seen Endpoints object for each service,
+	// keyed by namespace/name, so PodWeightChanged can recompute them.
+	// It is only populated when PodWeight is set.
+	endpoints map[string]*v1.Endpoints
 }
 
+// NodeWeightFunc returns the load balancing weight for endpoints scheduled
+// on the named node. Weights outside the range Envoy accepts are clamped.
+type NodeWeightFunc func(nodeName string) uint32
+
+// PodWeightFunc returns the load balancing weight override for the named
+// pod, and whether the pod has an override. Weights outside the range
+// Envoy accepts are clamped.
+type PodWeightFunc func(namespace, name string) (uint32, bool)
+
+const (
+	// minLoadBalancingWeight and maxLoadBalancingWeight are the bounds
+	// Envoy places on LbEndpoint.LoadBalancingWeight.
+	minLoadBalancingWeight = 1
+	maxLoadBalancingWeight = 128
+)
+
+// DuplicatePolicy describes how duplicate addresses within a single
+// ClusterLoadAssignment are handled.
+type DuplicatePolicy string
+
+const (
+	// DuplicateKeep emits one LbEndpoint per address, duplicates included.
+	DuplicateKeep DuplicatePolicy = ""
+
+	// DuplicateMax collapses duplicate addresses into a single LbEndpoint
+	// carrying the largest weight of the duplicates.
+	DuplicateMax DuplicatePolicy = "max"
+
+	// DuplicateSum collapses duplicate addresses into a single LbEndpoint
+	// carrying the sum of the weights of the duplicates.
+	DuplicateSum DuplicatePolicy = "sum"
+)
+
 func (e *EndpointsTranslator) OnAdd(obj interface{}) {
 	switch obj := obj.(type) {
 	case *v1.Endpoints:
@@ -68,10 +165,16 @@ func (e *EndpointsTranslator) OnDelete(obj interface{}) {
 }
 
 func (e *EndpointsTranslator) addEndpoints(ep *v1.Endpoints) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.track(ep.ObjectMeta, ep)
 	e.recomputeClusterLoadAssignment(nil, ep)
 }
 
 func (e *EndpointsTranslator) updateEndpoints(oldep, newep *v1.Endpoints) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.track(newep.ObjectMeta, newep)
 	if len(newep.Subsets) == 0 && len(oldep.Subsets) == 0 {
 		// if there are no endpoints in this object, and the old
 		// object also had zero endpoints, ignore this update
@@ -82,9 +185,57 @@ func (e *EndpointsTranslator) updateEndpoints(oldep, newep *v1.Endpoints) {
 }
 
 func (e *EndpointsTranslator) removeEndpoints(ep *v1.Endpoints) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.track(ep.ObjectMeta, nil)
 	e.recomputeClusterLoadAssignment(ep, nil)
 }
 
+// PodWeightChanged recomputes the ClusterLoadAssignments of every
+// Endpoints object with an address backed by the named pod.
+// It should be called whenever the weight reported by PodWeight for that
+// pod changes.
+func (e *EndpointsTranslator) PodWeightChanged(namespace, name string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, ep := range e.endpoints {
+		if targetspod(ep, namespace, name) {
+			e.recomputeClusterLoadAssignment(nil, ep)
+		}
+	}
+}
+
+// track records ep as the current Endpoints object for meta, or forgets
+// meta if ep is nil. Endpoints are only tracked when PodWeight is set.
+// e.mu must be held.
+func (e *EndpointsTranslator) track(meta metav1.ObjectMeta, ep *v1.Endpoints) {
+	if e.PodWeight == nil {
+		return
+	}
+	key := meta.Namespace + "/" + meta.Name
+	if ep == nil {
+		delete(e.endpoints, key)
+		return
+	}
+	if e.endpoints == nil {
+		e.endpoints = make(map[string]*v1.Endpoints)
+	}
+	e.endpoints[key] = ep
+}
+
+// targetspod reports whether any ready address of ep is backed by the
+// named pod.
+func targetspod(ep *v1.Endpoints, namespace, name string) bool {
+	for _, s := range ep.Subsets {
+		for _, a := range s.Addresses {
+			if r := a.TargetRef; r != nil && r.Kind == "Pod" && r.Namespace == namespace && r.Name == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // recomputeClusterLoadAssignment recomputes the EDS cache taking into account old and new endpoints.
 func (e *EndpointsTranslator) recomputeClusterLoadAssignment(oldep, newep *v1.Endpoints) {
 	// skip computation if either old and new services or endpoints are equal (thus also handling nil)
@@ -106,9 +257,58 @@ func (e *EndpointsTranslator) recomputeClusterLoadAssignment(oldep, newep *v1.En
 		}
 	}
 
-	clas := make(map[string]*v2.ClusterLoadAssignment)
 	// add or update endpoints
-	for _, s := range newep.Subsets {
+	clas, collapsed := e.clusterLoadAssignments(newep)
+
+	// iterate all the defined clusters and add or update them.
+	for portname, c := range clas {
+		if n := collapsed[portname]; n > 0 {
+			e.Warnf("cluster %q: collapsed %d duplicate endpoint(s) using policy %q", c.ClusterName, n, e.DuplicatePolicy)
+		}
+		if e.SkewWarningFraction > 0 && skewed(c, e.SkewWarningFraction) {
+			e.Warnf("cluster %q: the heaviest %g of endpoints would receive the majority of traffic", c.ClusterName, e.SkewWarningFraction)
+		}
+		e.Add(c)
+	}
+
+	// iterate over the ports in the old spec, remove any that are not
+	// mentioned in clas
+	for _, s := range oldep.Subsets {
+		if len(s.Addresses) == 0 {
+			continue
+		}
+		for _, p := range s.Ports {
+			// if this endpoint's service's port has a name, then the endpoint
+			// controller will apply the name here. The name may appear once per subset.
+			portname := p.Name
+			if _, ok := clas[portname]; !ok {
+				// port is not present in the list added / updated, so remove it
+				e.Remove(servicename(oldep.ObjectMeta, portname))
+			}
+		}
+	}
+}
+
+// LoadAssignment returns the ClusterLoadAssignment for the named port of
+// ep, built and weighted exactly as it would be for EDS. The result is
+// suitable for inlining into a STATIC cluster's LoadAssignment. If ep has
+// no ready addresses for portname, LoadAssignment returns nil.
+func (e *EndpointsTranslator) LoadAssignment(ep *v1.Endpoints, portname string) *v2.ClusterLoadAssignment {
+	clas, _ := e.clusterLoadAssignments(ep)
+	return clas[portname]
+}
+
+// clusterLoadAssignments returns the ClusterLoadAssignments for ep, keyed
+// by port name, along with the number of duplicate endpoints collapsed
+// from each. It does not log, so it is safe to call outside of EDS.
+func (e *EndpointsTranslator) clusterLoadAssignments(ep *v1.Endpoints) (map[string]*v2.ClusterLoadAssignment, map[string]int) {
+	var replicas map[string]map[string]int // port name to node name to endpoint count
+	if e.SplitNodeWeight {
+		replicas = e.nodereplicas(ep)
+	}
+
+	clas := make(map[string]*v2.ClusterLoadAssignment)
+	for _, s := range ep.Subsets {
 		// skip any subsets that don't have ready addresses
 		if len(s.Addresses) == 0 {
 			continue
@@ -122,35 +322,316 @@ func (e *EndpointsTranslator) recomputeClusterLoadAssignment(oldep, newep *v1.En
 			portname := p.Name
 			cla, ok := clas[portname]
 			if !ok {
-				cla = clusterloadassignment(servicename(newep.ObjectMeta, portname))
+				cla = clusterloadassignment(servicename(ep.ObjectMeta, portname))
 				clas[portname] = cla
 			}
 			for _, a := range s.Addresses {
-				cla.Endpoints[0].LbEndpoints = append(cla.Endpoints[0].LbEndpoints, lbendpoint(a.IP, p.Port))
+				lb := lbendpoint(a.IP, p.Port)
+				lb.LoadBalancingWeight = e.weight(a, replicas[portname])
+				if a.NodeName != nil && e.NodeDraining != nil && e.NodeDraining(*a.NodeName) {
+					lb.HealthStatus = core.HealthStatus_DRAINING
+				}
+				cla.Endpoints[0].LbEndpoints = append(cla.Endpoints[0].LbEndpoints, lb)
 			}
 		}
 	}
 
-	// iterate all the defined clusters and add or update them.
-	for _, c := range clas {
-		e.Add(c)
+	collapsed := make(map[string]int)
+	for portname, c := range clas {
+		collapsed[portname] = e.collapseDuplicates(c)
+		if e.ReduceWeights {
+			reduceWeights(c)
+		}
+		if e.WeightPercentages {
+			rescalePercentages(c)
+		}
+		if e.SortByWeight {
+			sortByWeight(c)
+		}
 	}
+	return clas, collapsed
+}
 
-	// iterate over the ports in the old spec, remove any that are not
-	// mentioned in clas
-	for _, s := range oldep.Subsets {
-		if len(s.Addresses) == 0 {
-			continue
+// weightSource describes where an endpoint's load balancing weight is
+// derived from.
+type weightSource int
+
+const (
+	// weightSourceDefault means neither a pod override nor a node weight
+	// applies, and the endpoint has Envoy's default weight.
+	weightSourceDefault weightSource = iota
+
+	// weightSourceNode means the weight is resolved via NodeWeight.
+	weightSourceNode
+
+	// weightSourcePod means the weight is overridden via PodWeight.
+	weightSourcePod
+)
+
+// weight returns the load balancing weight for a. replicas holds the number
+// of endpoints each node hosts in a's cluster when SplitNodeWeight is set.
+// If neither a pod override nor a node weight applies weight returns nil,
+// leaving the endpoint at Envoy's default weight.
+func (e *EndpointsTranslator) weight(a v1.EndpointAddress, replicas map[string]int) *types.UInt32Value {
+	w, source := e.rawweight(a)
+	switch source {
+	case weightSourcePod:
+		return &types.UInt32Value{Value: clampweight(e.scale(w))}
+	case weightSourceNode:
+		// clamp before splitting, so a node's replicas share at most
+		// Envoy's maximum weight however many of them there are.
+		w = clampweight(e.scale(w))
+		if n := replicas[*a.NodeName]; n > 1 {
+			w /= uint32(n)
+		}
+		return &types.UInt32Value{Value: clampweight(w)}
+	default:
+		return nil
+	}
+}
+
+// rawweight returns the unscaled weight for a and its source, preferring
+// a pod override to the weight of a's node.
+func (e *EndpointsTranslator) rawweight(a v1.EndpointAddress) (uint32, weightSource) {
+	if e.PodWeight != nil && a.TargetRef != nil && a.TargetRef.Kind == "Pod" {
+		if w, ok := e.PodWeight(a.TargetRef.Namespace, a.TargetRef.Name); ok {
+			return w, weightSourcePod
+		}
+	}
+	if e.NodeWeight != nil && a.NodeName != nil {
+		return e.NodeWeight(*a.NodeName), weightSourceNode
+	}
+	return 0, weightSourceDefault
+}
+
+// scale maps a resolved weight through e.LogScaleBase, if set.
+func (e *EndpointsTranslator) scale(w uint32) uint32 {
+	if e.LogScaleBase > 1 && w > 0 {
+		scaled := uint32(1)
+		for ; w >= e.LogScaleBase; w /= e.LogScaleBase {
+			scaled++
 		}
+		w = scaled
+	}
+	return w
+}
+
+// nodereplicas returns, for each port name in ep, the number of ready
+// addresses on each node whose weight is resolved via NodeWeight. Pod
+// overrides do not share their node's weight, so they are not counted.
+func (e *EndpointsTranslator) nodereplicas(ep *v1.Endpoints) map[string]map[string]int {
+	replicas := make(map[string]map[string]int)
+	for _, s := range ep.Subsets {
 		for _, p := range s.Ports {
-			// if this endpoint's service's port has a name, then the endpoint
-			// controller will apply the name here. The name may appear once per subset.
-			portname := p.Name
-			if _, ok := clas[portname]; !ok {
-				// port is not present in the list added / updated, so remove it
-				e.Remove(servicename(oldep.ObjectMeta, portname))
+			nodes, ok := replicas[p.Name]
+			if !ok {
+				nodes = make(map[string]int)
+				replicas[p.Name] = nodes
+			}
+			for _, a := range s.Addresses {
+				if _, source := e.rawweight(a); source == weightSourceNode {
+					nodes[*a.NodeName]++
+				}
+			}
+		}
+	}
+	return replicas
+}
+
+// collapseDuplicates merges LbEndpoints in cla which share the same
+// socket address according to e.DuplicatePolicy, and returns the number
+// of endpoints removed. The position of the first occurrence of each
+// address is preserved.
+func (e *EndpointsTranslator) collapseDuplicates(cla *v2.ClusterLoadAssignment) int {
+	if e.DuplicatePolicy == DuplicateKeep {
+		return 0
+	}
+	var dups int
+	for i := range cla.Endpoints {
+		lbendpoints := cla.Endpoints[i].LbEndpoints
+		seen := make(map[string]int) // address to index in collapsed
+		var collapsed []endpoint.LbEndpoint
+		for _, lb := range lbendpoints {
+			addr := envoy.EndpointAddress(lb)
+			j, ok := seen[addr]
+			if !ok {
+				seen[addr] = len(collapsed)
+				collapsed = append(collapsed, lb)
+				continue
+			}
+			prev, cur := lbweight(collapsed[j]), lbweight(lb)
+			switch e.DuplicatePolicy {
+			case DuplicateSum:
+				collapsed[j].LoadBalancingWeight = &types.UInt32Value{Value: clampweight(prev + cur)}
+			case DuplicateMax:
+				if cur > prev {
+					collapsed[j].LoadBalancingWeight = &types.UInt32Value{Value: cur}
+				}
+			}
+		}
+		if n := len(lbendpoints) - len(collapsed); n > 0 {
+			dups += n
+			cla.Endpoints[i].LbEndpoints = collapsed
+		}
+	}
+	return dups
+}
+
+// reduceWeights divides the endpoint weights of cla by their greatest common
+// divisor. Unset weights count as 1, so a cluster with any unset weight is
+// left unchanged.
+func reduceWeights(cla *v2.ClusterLoadAssignment) {
+	var d uint32
+	for _, l := range cla.Endpoints {
+		for _, lb := range l.LbEndpoints {
+			d = gcd(d, lbweight(lb))
+		}
+	}
+	if d <= 1 {
+		return
+	}
+	for i := range cla.Endpoints {
+		lbendpoints := cla.Endpoints[i].LbEndpoints
+		for j := range lbendpoints {
+			lbendpoints[j].LoadBalancingWeight = &types.UInt32Value{Value: lbweight(lbendpoints[j]) / d}
+		}
+	}
+}
+
+// gcd returns the greatest common divisor of a and b.
+func gcd(a, b uint32) uint32 {
+	for b != 0 {
+		a, b = b, a%b
+	}
+	return a
+}
+
+// skewed reports whether the heaviest fraction of cla's endpoints, rounded
+// up to at least one endpoint, carry more than half of its total weight.
+// A cluster too small for fraction to single out fewer than all of its
+// endpoints is never skewed.
+func skewed(cla *v2.ClusterLoadAssignment, fraction float64) bool {
+	var weights []uint32
+	var total uint64
+	for _, l := range cla.Endpoints {
+		for _, lb := range l.LbEndpoints {
+			w := lbweight(lb)
+			weights = append(weights, w)
+			total += uint64(w)
+		}
+	}
+	n := int(math.Ceil(fraction * float64(len(weights))))
+	if n >= len(weights) {
+		return false
+	}
+	sort.Slice(weights, func(i, j int) bool {
+		return weights[i] > weights[j]
+	})
+	var heaviest uint64
+	for _, w := range weights[:n] {
+		heaviest += uint64(w)
+	}
+	return heaviest*2 > total
+}
+
+// rescalePercentages rescales the endpoint weights of each locality in cla
+// so they sum to 100. Envoy does not accept a weight of zero, so a share
+// which rounds down to zero is first raised to 1, taking the point back from
+// the largest share. The remainder left by integer division is then handed
+// out one point at a time to the other endpoints with the largest
+// remainders, ties going to the earlier endpoint. The total is exactly 100
+// unless a locality has more than 100 endpoints.
+func rescalePercentages(cla *v2.ClusterLoadAssignment) {
+	for i := range cla.Endpoints {
+		lbendpoints := cla.Endpoints[i].LbEndpoints
+		var total uint64
+		for _, lb := range lbendpoints {
+			total += uint64(lbweight(lb))
+		}
+		if total == 0 {
+			continue
+		}
+
+		shares := make([]uint64, len(lbendpoints))
+		remainders := make([]uint64, len(lbendpoints))
+		var order []int
+		var assigned uint64
+		for j, lb := range lbendpoints {
+			n := uint64(lbweight(lb)) * 100
+			shares[j] = n / total
+			remainders[j] = n % total
+			if shares[j] == 0 {
+				// reserve the minimum weight; this endpoint already
+				// has more than its share, so takes no remainder.
+				shares[j] = 1
+			} else {
+				order = append(order, j)
+			}
+			assigned += shares[j]
+		}
+
+		// pay for the reserved points from the largest shares.
+		for assigned > 100 {
+			largest := 0
+			for j := range shares {
+				if shares[j] > shares[largest] || (shares[j] == shares[largest] && remainders[j] < remainders[largest]) {
+					largest = j
+				}
+			}
+			if shares[largest] <= 1 {
+				break // more than 100 endpoints
 			}
+			shares[largest]--
+			assigned--
 		}
+
+		sort.SliceStable(order, func(a, b int) bool {
+			return remainders[order[a]] > remainders[order[b]]
+		})
+		for k := 0; assigned < 100 && k < len(order); k++ {
+			shares[order[k]]++
+			assigned++
+		}
+
+		for j := range lbendpoints {
+			lbendpoints[j].LoadBalancingWeight = &types.UInt32Value{Value: clampweight(uint32(shares[j]))}
+		}
+	}
+}
+
+// sortByWeight sorts the endpoints of each locality in cla by descending
+// weight, then by ascending address.
+func sortByWeight(cla *v2.ClusterLoadAssignment) {
+	for i := range cla.Endpoints {
+		lbendpoints := cla.Endpoints[i].LbEndpoints
+		sort.SliceStable(lbendpoints, func(a, b int) bool {
+			wa, wb := lbweight(lbendpoints[a]), lbweight(lbendpoints[b])
+			if wa != wb {
+				return wa > wb
+			}
+			return envoy.EndpointAddress(lbendpoints[a]) < envoy.EndpointAddress(lbendpoints[b])
+		})
+	}
+}
+
+// lbweight returns the load balancing weight of lb. Envoy treats an
+// unset weight as 1.
+func lbweight(lb endpoint.LbEndpoint) uint32 {
+	if lb.LoadBalancingWeight == nil {
+		return 1
+	}
+	return lb.LoadBalancingWeight.Value
+}
+
+// clampweight returns w constrained to the range of weights Envoy accepts.
+func clampweight(w uint32) uint32 {
+	switch {
+	case w < minLoadBalancingWeight:
+		return minLoadBalancingWeight
+	case w > maxLoadBalancingWeight:
+		return maxLoadBalancingWeight
+	default:
+		return w
 	}
 }
 
@@ -14,12 +14,19 @@
 package contour
 
 import (
+	"bytes"
 	"reflect"
 	"sort"
+	"strings"
 	"testing"
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
 	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/heptio/contour/internal/envoy"
+	"github.com/sirupsen/logrus"
 	"k8s.io/api/core/v1"
 )
 
@@ -259,6 +266,939 @@ func TestEndpointsTranslatorScaleToZeroEndpoints(t *testing.T) {
 	}
 }
 
+func TestEndpointsTranslatorDuplicateAddresses(t *testing.T) {
+	// the same address appears in two subsets, as well as twice in the first.
+	ep := endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: addresses("192.168.183.24", "192.168.183.25", "192.168.183.24"),
+		Ports:     ports(8080),
+	}, v1.EndpointSubset{
+		Addresses: addresses("192.168.183.24"),
+		Ports:     ports(8080),
+	})
+
+	tests := map[string]struct {
+		policy DuplicatePolicy
+		want   []proto.Message
+	}{
+		"keep": {
+			policy: DuplicateKeep,
+			want: []proto.Message{
+				clusterloadassignment("default/simple",
+					lbendpoint("192.168.183.24", 8080),
+					lbendpoint("192.168.183.25", 8080),
+					lbendpoint("192.168.183.24", 8080),
+					lbendpoint("192.168.183.24", 8080),
+				),
+			},
+		},
+		"max": {
+			policy: DuplicateMax,
+			want: []proto.Message{
+				clusterloadassignment("default/simple",
+					lbendpoint("192.168.183.24", 8080),
+					lbendpoint("192.168.183.25", 8080),
+				),
+			},
+		},
+		"sum": {
+			policy: DuplicateSum,
+			want: []proto.Message{
+				clusterloadassignment("default/simple",
+					weightedlbendpoint("192.168.183.24", 8080, 3),
+					lbendpoint("192.168.183.25", 8080),
+				),
+			},
+		},
+	}
+
+	log := testLogger(t)
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			et := &EndpointsTranslator{
+				FieldLogger:     log,
+				DuplicatePolicy: tc.policy,
+			}
+			et.OnAdd(ep)
+			got := contents(et)
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected:\n%v\ngot:\n%v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestEndpointsTranslatorDuplicateWeights(t *testing.T) {
+	// the same address is reported on two nodes with different weights.
+	weights := map[string]uint32{
+		"node-a": 10,
+		"node-b": 90,
+		"node-c": 50,
+	}
+	ep := endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.24", "node-a"),
+			addressOnNode("192.168.183.25", "node-c"),
+			addressOnNode("192.168.183.24", "node-b"),
+		},
+		Ports: ports(8080),
+	})
+
+	tests := map[string]struct {
+		policy  DuplicatePolicy
+		want    []proto.Message
+		wantlog string
+	}{
+		"keep": {
+			policy: DuplicateKeep,
+			want: []proto.Message{
+				clusterloadassignment("default/simple",
+					weightedlbendpoint("192.168.183.24", 8080, 10),
+					weightedlbendpoint("192.168.183.25", 8080, 50),
+					weightedlbendpoint("192.168.183.24", 8080, 90),
+				),
+			},
+		},
+		"max keeps the larger weight": {
+			policy: DuplicateMax,
+			want: []proto.Message{
+				clusterloadassignment("default/simple",
+					weightedlbendpoint("192.168.183.24", 8080, 90),
+					weightedlbendpoint("192.168.183.25", 8080, 50),
+				),
+			},
+			wantlog: `cluster \"default/simple\": collapsed 1 duplicate endpoint(s) using policy \"max\"`,
+		},
+		"sum": {
+			policy: DuplicateSum,
+			want: []proto.Message{
+				clusterloadassignment("default/simple",
+					weightedlbendpoint("192.168.183.24", 8080, 100),
+					weightedlbendpoint("192.168.183.25", 8080, 50),
+				),
+			},
+			wantlog: `cluster \"default/simple\": collapsed 1 duplicate endpoint(s) using policy \"sum\"`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			log, buf := bufferLogger()
+			et := &EndpointsTranslator{
+				FieldLogger: log,
+				NodeWeight: func(node string) uint32 {
+					return weights[node]
+				},
+				DuplicatePolicy: tc.policy,
+			}
+			et.OnAdd(ep)
+			got := contents(et)
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected:\n%v\ngot:\n%v", tc.want, got)
+			}
+			if tc.wantlog == "" {
+				if buf.Len() > 0 {
+					t.Fatalf("expected no log, got: %s", buf)
+				}
+			} else if !strings.Contains(buf.String(), tc.wantlog) {
+				t.Fatalf("expected log containing %s, got: %s", tc.wantlog, buf)
+			}
+		})
+	}
+
+	// summing past Envoy's maximum weight clamps to the maximum.
+	et := &EndpointsTranslator{
+		FieldLogger: testLogger(t),
+		NodeWeight: func(node string) uint32 {
+			return 100
+		},
+		DuplicatePolicy: DuplicateSum,
+	}
+	et.OnAdd(endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.24", "node-a"),
+			addressOnNode("192.168.183.24", "node-b"),
+		},
+		Ports: ports(8080),
+	}))
+	want := []proto.Message{
+		clusterloadassignment("default/simple", weightedlbendpoint("192.168.183.24", 8080, 128)),
+	}
+	if got := contents(et); !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+	}
+}
+
+// bufferLogger returns a logger which writes plain text to the returned buffer.
+func bufferLogger() (logrus.FieldLogger, *bytes.Buffer) {
+	var buf bytes.Buffer
+	log := logrus.New()
+	log.Out = &buf
+	log.Formatter = &logrus.TextFormatter{DisableColors: true, DisableTimestamp: true}
+	return log, &buf
+}
+
+func TestEndpointsTranslatorGolden(t *testing.T) {
+	tests := map[string]struct {
+		setup func(*EndpointsTranslator)
+		ep    *v1.Endpoints
+		want  []string
+	}{
+		"multiple ports": {
+			ep: endpoints("default", "multi", v1.EndpointSubset{
+				Addresses: addresses("172.16.0.2", "172.16.0.1"),
+				Ports: []v1.EndpointPort{{
+					Name: "http",
+					Port: 8080,
+				}, {
+					Name: "https",
+					Port: 8443,
+				}},
+			}),
+			want: []string{`cluster default/multi/http
+  locality "" priority=0
+    172.16.0.1:8080 weight=1
+    172.16.0.2:8080 weight=1
+`, `cluster default/multi/https
+  locality "" priority=0
+    172.16.0.1:8443 weight=1
+    172.16.0.2:8443 weight=1
+`},
+		},
+		"node weighted": {
+			setup: func(et *EndpointsTranslator) {
+				weights := map[string]uint32{
+					"node-a": 40,
+					"node-b": 200,
+				}
+				et.NodeWeight = func(node string) uint32 {
+					return weights[node]
+				}
+				et.NodeDraining = func(node string) bool {
+					return node == "node-b"
+				}
+				et.SplitNodeWeight = true
+			},
+			ep: endpoints("default", "weighted", v1.EndpointSubset{
+				Addresses: []v1.EndpointAddress{
+					addressOnNode("172.16.0.1", "node-a"),
+					addressOnNode("172.16.0.2", "node-a"),
+					addressOnNode("2001:db8::3", "node-b"),
+					{IP: "172.16.0.4"}, // no node name
+				},
+				Ports: ports(80),
+			}),
+			want: []string{`cluster default/weighted
+  locality "" priority=0
+    172.16.0.1:80 weight=20
+    172.16.0.2:80 weight=20
+    172.16.0.4:80 weight=1
+    [2001:db8::3]:80 weight=128 health=DRAINING
+`},
+		},
+	}
+
+	log := testLogger(t)
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			et := &EndpointsTranslator{
+				FieldLogger: log,
+			}
+			if tc.setup != nil {
+				tc.setup(et)
+			}
+			et.OnAdd(tc.ep)
+			contents := contents(et)
+			sort.Stable(clusterLoadAssignmentsByName(contents))
+			var got []string
+			for _, c := range contents {
+				got = append(got, envoy.FormatClusterLoadAssignment(c.(*v2.ClusterLoadAssignment)))
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected:\n%v\ngot:\n%v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestEndpointsTranslatorNodeWeight(t *testing.T) {
+	weights := map[string]uint32{
+		"node-a": 10,
+		"node-b": 0,   // clamped up
+		"node-c": 500, // clamped down
+	}
+	et := &EndpointsTranslator{
+		FieldLogger: testLogger(t),
+		NodeWeight: func(node string) uint32 {
+			return weights[node]
+		},
+	}
+	et.OnAdd(endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.24", "node-a"),
+			addressOnNode("192.168.183.25", "node-b"),
+			addressOnNode("192.168.183.26", "node-c"),
+			{IP: "192.168.183.27"}, // no node name
+		},
+		Ports: ports(8080),
+	}))
+
+	want := []proto.Message{
+		clusterloadassignment("default/simple",
+			weightedlbendpoint("192.168.183.24", 8080, 10),
+			weightedlbendpoint("192.168.183.25", 8080, 1),
+			weightedlbendpoint("192.168.183.26", 8080, 128),
+			lbendpoint("192.168.183.27", 8080),
+		),
+	}
+	got := contents(et)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+	}
+}
+
+func TestEndpointsTranslatorWeightOptions(t *testing.T) {
+	percentages := func(e *EndpointsTranslator) { e.WeightPercentages = true }
+	reduce := func(e *EndpointsTranslator) { e.ReduceWeights = true }
+
+	tests := map[string]struct {
+		setup   func(*EndpointsTranslator)
+		weights map[string]uint32
+		want    []uint32
+	}{
+		"percentages: already percentages": {
+			setup:   percentages,
+			weights: map[string]uint32{"node-a": 10, "node-b": 30, "node-c": 60},
+			want:    []uint32{10, 30, 60},
+		},
+		"percentages: equal weights": {
+			setup:   percentages,
+			weights: map[string]uint32{"node-a": 1, "node-b": 1, "node-c": 1},
+			want:    []uint32{34, 33, 33},
+		},
+		"percentages: uneven remainders": {
+			setup:   percentages,
+			weights: map[string]uint32{"node-a": 1, "node-b": 2, "node-c": 4},
+			// 14.29, 28.57, 57.14
+			want: []uint32{14, 29, 57},
+		},
+		"percentages: share rounds to zero": {
+			setup:   percentages,
+			weights: map[string]uint32{"node-a": 1, "node-b": 128, "node-c": 128},
+			// 0.39, 49.81, 49.81; the 1 is reserved before the
+			// remainder is handed out.
+			want: []uint32{1, 50, 49},
+		},
+		"reduce: common divisor": {
+			setup:   reduce,
+			weights: map[string]uint32{"node-a": 20, "node-b": 40, "node-c": 60},
+			want:    []uint32{1, 2, 3},
+		},
+		"reduce: ratios preserved": {
+			setup:   reduce,
+			weights: map[string]uint32{"node-a": 12, "node-b": 18, "node-c": 30},
+			want:    []uint32{2, 3, 5},
+		},
+		"reduce: coprime weights unchanged": {
+			setup:   reduce,
+			weights: map[string]uint32{"node-a": 3, "node-b": 5, "node-c": 7},
+			want:    []uint32{3, 5, 7},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			et := &EndpointsTranslator{
+				FieldLogger: testLogger(t),
+				NodeWeight: func(node string) uint32 {
+					return tc.weights[node]
+				},
+			}
+			tc.setup(et)
+			et.OnAdd(endpoints("default", "simple", v1.EndpointSubset{
+				Addresses: []v1.EndpointAddress{
+					addressOnNode("192.168.183.24", "node-a"),
+					addressOnNode("192.168.183.25", "node-b"),
+					addressOnNode("192.168.183.26", "node-c"),
+				},
+				Ports: ports(8080),
+			}))
+
+			want := []proto.Message{
+				clusterloadassignment("default/simple",
+					weightedlbendpoint("192.168.183.24", 8080, tc.want[0]),
+					weightedlbendpoint("192.168.183.25", 8080, tc.want[1]),
+					weightedlbendpoint("192.168.183.26", 8080, tc.want[2]),
+				),
+			}
+			got := contents(et)
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+			}
+		})
+	}
+
+	// reducing by the GCD leaves a cluster with a default weight endpoint
+	// unchanged.
+	et := &EndpointsTranslator{
+		FieldLogger: testLogger(t),
+		NodeWeight: func(node string) uint32 {
+			return 20
+		},
+		ReduceWeights: true,
+	}
+	et.OnAdd(endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.24", "node-a"),
+			{IP: "192.168.183.25"},
+		},
+		Ports: ports(8080),
+	}))
+	want := []proto.Message{
+		clusterloadassignment("default/simple",
+			weightedlbendpoint("192.168.183.24", 8080, 20),
+			lbendpoint("192.168.183.25", 8080),
+		),
+	}
+	if got := contents(et); !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+	}
+}
+
+func TestRescalePercentages(t *testing.T) {
+	tests := map[string]struct {
+		weights []uint32
+		want    []uint32
+	}{
+		"reserved points taken from the largest share": {
+			// 0.8 x 5, 96; the five reserved points leave 95.
+			weights: []uint32{1, 1, 1, 1, 1, 120},
+			want:    []uint32{1, 1, 1, 1, 1, 95},
+		},
+		"more than 100 endpoints": {
+			weights: repeat(1, 101),
+			want:    repeat(1, 101),
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			var lbendpoints []endpoint.LbEndpoint
+			for i, w := range tc.weights {
+				lbendpoints = append(lbendpoints, weightedlbendpoint("192.168.183.24", int32(8000+i), w))
+			}
+			cla := clusterloadassignment("default/simple", lbendpoints...)
+			rescalePercentages(cla)
+
+			var got []uint32
+			for _, lb := range cla.Endpoints[0].LbEndpoints {
+				got = append(got, lbweight(lb))
+			}
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected: %v, got: %v", tc.want, got)
+			}
+		})
+	}
+}
+
+// repeat returns n copies of w.
+func repeat(w uint32, n int) []uint32 {
+	ws := make([]uint32, n)
+	for i := range ws {
+		ws[i] = w
+	}
+	return ws
+}
+
+func TestEndpointsTranslatorSortByWeight(t *testing.T) {
+	weights := map[string]uint32{
+		"node-a": 5,
+		"node-b": 20,
+		"node-c": 5,
+	}
+	ep := endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.26", "node-c"),
+			addressOnNode("192.168.183.24", "node-a"),
+			{IP: "192.168.183.27"}, // no node name, default weight
+			addressOnNode("192.168.183.25", "node-b"),
+		},
+		Ports: ports(8080),
+	})
+
+	tests := map[string]struct {
+		sort bool
+		want []proto.Message
+	}{
+		"unsorted": {
+			sort: false,
+			want: []proto.Message{
+				clusterloadassignment("default/simple",
+					weightedlbendpoint("192.168.183.26", 8080, 5),
+					weightedlbendpoint("192.168.183.24", 8080, 5),
+					lbendpoint("192.168.183.27", 8080),
+					weightedlbendpoint("192.168.183.25", 8080, 20),
+				),
+			},
+		},
+		"sorted": {
+			sort: true,
+			want: []proto.Message{
+				clusterloadassignment("default/simple",
+					weightedlbendpoint("192.168.183.25", 8080, 20),
+					weightedlbendpoint("192.168.183.24", 8080, 5),
+					weightedlbendpoint("192.168.183.26", 8080, 5),
+					lbendpoint("192.168.183.27", 8080),
+				),
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			et := &EndpointsTranslator{
+				FieldLogger: testLogger(t),
+				NodeWeight: func(node string) uint32 {
+					return weights[node]
+				},
+				SortByWeight: tc.sort,
+			}
+			et.OnAdd(ep)
+			got := contents(et)
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected:\n%v\ngot:\n%v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestEndpointsTranslatorNodeDraining(t *testing.T) {
+	et := &EndpointsTranslator{
+		FieldLogger: testLogger(t),
+		NodeWeight: func(node string) uint32 {
+			return 10
+		},
+		NodeDraining: func(node string) bool {
+			return node == "node-b"
+		},
+	}
+	et.OnAdd(endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.24", "node-a"),
+			addressOnNode("192.168.183.25", "node-b"),
+			{IP: "192.168.183.26"}, // no node name
+		},
+		Ports: ports(8080),
+	}))
+
+	draining := weightedlbendpoint("192.168.183.25", 8080, 10)
+	draining.HealthStatus = core.HealthStatus_DRAINING
+	want := []proto.Message{
+		clusterloadassignment("default/simple",
+			weightedlbendpoint("192.168.183.24", 8080, 10),
+			draining,
+			lbendpoint("192.168.183.26", 8080),
+		),
+	}
+	got := contents(et)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+	}
+}
+
+func TestEndpointsTranslatorLoadAssignment(t *testing.T) {
+	ep := endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.24", "node-a"),
+			addressOnNode("192.168.183.25", "node-b"),
+			addressOnNode("192.168.183.24", "node-a"),
+		},
+		Ports: []v1.EndpointPort{{
+			Name: "http",
+			Port: 8080,
+		}, {
+			Name: "https",
+			Port: 8443,
+		}},
+	})
+	weights := map[string]uint32{
+		"node-a": 2,
+		"node-b": 6,
+	}
+	et := &EndpointsTranslator{
+		FieldLogger: testLogger(t),
+		NodeWeight: func(node string) uint32 {
+			return weights[node]
+		},
+		DuplicatePolicy:   DuplicateSum,
+		WeightPercentages: true,
+		SortByWeight:      true,
+	}
+
+	// the inline assignment must match what EDS would serve.
+	et.OnAdd(ep)
+	eds := contents(et)
+	sort.Stable(clusterLoadAssignmentsByName(eds))
+	want := []proto.Message{
+		clusterloadassignment("default/simple/http",
+			weightedlbendpoint("192.168.183.25", 8080, 60),
+			weightedlbendpoint("192.168.183.24", 8080, 40),
+		),
+		clusterloadassignment("default/simple/https",
+			weightedlbendpoint("192.168.183.25", 8443, 60),
+			weightedlbendpoint("192.168.183.24", 8443, 40),
+		),
+	}
+	if !reflect.DeepEqual(want, eds) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, eds)
+	}
+
+	for i, portname := range []string{"http", "https"} {
+		got := et.LoadAssignment(ep, portname)
+		if !reflect.DeepEqual(eds[i], got) {
+			t.Errorf("%s: expected:\n%v\ngot:\n%v", portname, eds[i], got)
+		}
+	}
+
+	if got := et.LoadAssignment(ep, "missing"); got != nil {
+		t.Errorf("missing: expected nil, got: %v", got)
+	}
+
+	// read only queries must not repeat the EDS path's collapse warning.
+	log, buf := bufferLogger()
+	et.FieldLogger = log
+	et.LoadAssignment(ep, "http")
+	if buf.Len() > 0 {
+		t.Errorf("LoadAssignment: expected no log, got: %s", buf)
+	}
+}
+
+func TestEndpointsTranslatorPodWeight(t *testing.T) {
+	et := &EndpointsTranslator{
+		FieldLogger: testLogger(t),
+		NodeWeight: func(node string) uint32 {
+			return 10
+		},
+		PodWeight: func(namespace, name string) (uint32, bool) {
+			if namespace == "default" && name == "simple-2" {
+				return 50, true
+			}
+			return 0, false
+		},
+	}
+
+	pod := func(ip, node, name string) v1.EndpointAddress {
+		a := addressOnNode(ip, node)
+		a.TargetRef = &v1.ObjectReference{
+			Kind:      "Pod",
+			Namespace: "default",
+			Name:      name,
+		}
+		return a
+	}
+	et.OnAdd(endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			pod("192.168.183.24", "node-a", "simple-1"),
+			pod("192.168.183.25", "node-a", "simple-2"), // overridden
+			pod("192.168.183.26", "node-b", "simple-3"),
+		},
+		Ports: ports(8080),
+	}))
+
+	want := []proto.Message{
+		clusterloadassignment("default/simple",
+			weightedlbendpoint("192.168.183.24", 8080, 10),
+			weightedlbendpoint("192.168.183.25", 8080, 50),
+			weightedlbendpoint("192.168.183.26", 8080, 10),
+		),
+	}
+	got := contents(et)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+	}
+}
+
+func TestEndpointsTranslatorLogScale(t *testing.T) {
+	weights := map[string]uint32{
+		"node-a": 0,
+		"node-b": 1,
+		"node-c": 10,
+		"node-d": 99,
+		"node-e": 1000,
+		"node-f": 100000,
+	}
+	ep := endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.20", "node-a"),
+			addressOnNode("192.168.183.21", "node-b"),
+			addressOnNode("192.168.183.22", "node-c"),
+			addressOnNode("192.168.183.23", "node-d"),
+			addressOnNode("192.168.183.24", "node-e"),
+			addressOnNode("192.168.183.25", "node-f"),
+		},
+		Ports: ports(8080),
+	})
+
+	tests := map[string]struct {
+		base uint32
+		want []uint32
+	}{
+		"linear": {
+			base: 0,
+			want: []uint32{1, 1, 10, 99, 128, 128},
+		},
+		"log base 10": {
+			base: 10,
+			want: []uint32{1, 1, 2, 2, 4, 6},
+		},
+		"log base 2": {
+			base: 2,
+			want: []uint32{1, 1, 4, 7, 10, 17},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			et := &EndpointsTranslator{
+				FieldLogger: testLogger(t),
+				NodeWeight: func(node string) uint32 {
+					return weights[node]
+				},
+				LogScaleBase: tc.base,
+			}
+			et.OnAdd(ep)
+
+			var lbendpoints []endpoint.LbEndpoint
+			for i, w := range tc.want {
+				lbendpoints = append(lbendpoints, weightedlbendpoint(ep.Subsets[0].Addresses[i].IP, 8080, w))
+			}
+			want := []proto.Message{
+				clusterloadassignment("default/simple", lbendpoints...),
+			}
+			got := contents(et)
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+			}
+		})
+	}
+}
+
+func TestEndpointsTranslatorSplitNodeWeight(t *testing.T) {
+	weights := map[string]uint32{
+		"node-a": 60,
+		"node-b": 60,
+		"node-c": 1,
+		"node-d": 500,
+		"node-e": 500,
+	}
+	ep := endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.24", "node-a"),
+			addressOnNode("192.168.183.25", "node-a"),
+			addressOnNode("192.168.183.26", "node-a"),
+			addressOnNode("192.168.183.27", "node-b"),
+			addressOnNode("192.168.183.28", "node-c"),
+			addressOnNode("192.168.183.29", "node-c"),
+			addressOnNode("192.168.183.31", "node-d"),
+			addressOnNode("192.168.183.32", "node-d"),
+			addressOnNode("192.168.183.33", "node-e"),
+		},
+		Ports: []v1.EndpointPort{{
+			Name: "http",
+			Port: 8080,
+		}},
+	}, v1.EndpointSubset{
+		// node-b's second replica only serves another port, so it
+		// belongs to a different cluster.
+		Addresses: []v1.EndpointAddress{
+			addressOnNode("192.168.183.30", "node-b"),
+		},
+		Ports: []v1.EndpointPort{{
+			Name: "metrics",
+			Port: 9090,
+		}},
+	})
+
+	tests := map[string]struct {
+		split bool
+		want  []proto.Message
+	}{
+		"per endpoint": {
+			split: false,
+			want: []proto.Message{
+				clusterloadassignment("default/simple/http",
+					weightedlbendpoint("192.168.183.24", 8080, 60),
+					weightedlbendpoint("192.168.183.25", 8080, 60),
+					weightedlbendpoint("192.168.183.26", 8080, 60),
+					weightedlbendpoint("192.168.183.27", 8080, 60),
+					weightedlbendpoint("192.168.183.28", 8080, 1),
+					weightedlbendpoint("192.168.183.29", 8080, 1),
+					weightedlbendpoint("192.168.183.31", 8080, 128),
+					weightedlbendpoint("192.168.183.32", 8080, 128),
+					weightedlbendpoint("192.168.183.33", 8080, 128),
+				),
+				clusterloadassignment("default/simple/metrics",
+					weightedlbendpoint("192.168.183.30", 9090, 60),
+				),
+			},
+		},
+		"split across replicas": {
+			split: true,
+			want: []proto.Message{
+				clusterloadassignment("default/simple/http",
+					weightedlbendpoint("192.168.183.24", 8080, 20),
+					weightedlbendpoint("192.168.183.25", 8080, 20),
+					weightedlbendpoint("192.168.183.26", 8080, 20),
+					weightedlbendpoint("192.168.183.27", 8080, 60),
+					// 1/2 is clamped to Envoy's minimum
+					weightedlbendpoint("192.168.183.28", 8080, 1),
+					weightedlbendpoint("192.168.183.29", 8080, 1),
+					// 500 is clamped to 128 before it is split, so
+					// node-d and node-e receive equal traffic.
+					weightedlbendpoint("192.168.183.31", 8080, 64),
+					weightedlbendpoint("192.168.183.32", 8080, 64),
+					weightedlbendpoint("192.168.183.33", 8080, 128),
+				),
+				clusterloadassignment("default/simple/metrics",
+					weightedlbendpoint("192.168.183.30", 9090, 60),
+				),
+			},
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			et := &EndpointsTranslator{
+				FieldLogger: testLogger(t),
+				NodeWeight: func(node string) uint32 {
+					return weights[node]
+				},
+				SplitNodeWeight: tc.split,
+			}
+			et.OnAdd(ep)
+			got := contents(et)
+			sort.Stable(clusterLoadAssignmentsByName(got))
+			if !reflect.DeepEqual(tc.want, got) {
+				t.Fatalf("expected:\n%v\ngot:\n%v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestEndpointsTranslatorSplitNodeWeightPodOverride(t *testing.T) {
+	override := addressOnNode("192.168.183.24", "node-a")
+	override.TargetRef = &v1.ObjectReference{
+		Kind:      "Pod",
+		Namespace: "default",
+		Name:      "simple-1",
+	}
+	ep := endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{
+			override,
+			addressOnNode("192.168.183.25", "node-a"),
+		},
+		Ports: ports(8080),
+	})
+
+	et := &EndpointsTranslator{
+		FieldLogger: testLogger(t),
+		NodeWeight: func(node string) uint32 {
+			return 60
+		},
+		PodWeight: func(namespace, name string) (uint32, bool) {
+			return 5, name == "simple-1"
+		},
+		SplitNodeWeight: true,
+	}
+	et.OnAdd(ep)
+
+	// the overridden pod keeps its own weight and does not take a share
+	// of node-a's weight from the remaining replica.
+	want := []proto.Message{
+		clusterloadassignment("default/simple",
+			weightedlbendpoint("192.168.183.24", 8080, 5),
+			weightedlbendpoint("192.168.183.25", 8080, 60),
+		),
+	}
+	got := contents(et)
+	if !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+	}
+}
+
+func TestEndpointsTranslatorSkewWarning(t *testing.T) {
+	tests := map[string]struct {
+		weights  map[string]uint32
+		fraction float64
+		warn     bool
+	}{
+		"balanced": {
+			weights:  map[string]uint32{"node-a": 10, "node-b": 10, "node-c": 10, "node-d": 10},
+			fraction: 0.25,
+			warn:     false,
+		},
+		"one heavy endpoint": {
+			// 100 of 130 goes to a quarter of the endpoints
+			weights:  map[string]uint32{"node-a": 100, "node-b": 10, "node-c": 10, "node-d": 10},
+			fraction: 0.25,
+			warn:     true,
+		},
+		"exactly half is not a majority": {
+			weights:  map[string]uint32{"node-a": 30, "node-b": 10, "node-c": 10, "node-d": 10},
+			fraction: 0.25,
+			warn:     false,
+		},
+		"fraction covers every endpoint": {
+			weights:  map[string]uint32{"node-a": 100, "node-b": 10, "node-c": 10, "node-d": 10},
+			fraction: 1,
+			warn:     false,
+		},
+		"disabled": {
+			weights:  map[string]uint32{"node-a": 100, "node-b": 10, "node-c": 10, "node-d": 10},
+			fraction: 0,
+			warn:     false,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			log, buf := bufferLogger()
+			et := &EndpointsTranslator{
+				FieldLogger: log,
+				NodeWeight: func(node string) uint32 {
+					return tc.weights[node]
+				},
+				SkewWarningFraction: tc.fraction,
+			}
+			et.OnAdd(endpoints("default", "simple", v1.EndpointSubset{
+				Addresses: []v1.EndpointAddress{
+					addressOnNode("192.168.183.24", "node-a"),
+					addressOnNode("192.168.183.25", "node-b"),
+					addressOnNode("192.168.183.26", "node-c"),
+					addressOnNode("192.168.183.27", "node-d"),
+				},
+				Ports: ports(8080),
+			}))
+			const want = `cluster \"default/simple\": the heaviest 0.25 of endpoints would receive the majority of traffic`
+			if got := strings.Contains(buf.String(), want); got != tc.warn {
+				t.Fatalf("expected warning: %v, got log: %q", tc.warn, buf)
+			}
+		})
+	}
+}
+
+func addressOnNode(ip, node string) v1.EndpointAddress {
+	return v1.EndpointAddress{
+		IP:       ip,
+		NodeName: &node,
+	}
+}
+
+func weightedlbendpoint(addr string, port int32, weight uint32) endpoint.LbEndpoint {
+	lb := lbendpoint(addr, port)
+	lb.LoadBalancingWeight = &types.UInt32Value{Value: weight}
+	return lb
+}
+
 type clusterLoadAssignmentsByName []proto.Message
 
 func (c clusterLoadAssignmentsByName) Len() int      { return len(c) }
@@ -0,0 +1,111 @@
+// Copyright © 2018 Heptio
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contour
+
+import (
+	"sync"
+
+	"github.com/gogo/protobuf/types"
+	"github.com/sirupsen/logrus"
+	"k8s.io/api/core/v1"
+	_cache "k8s.io/client-go/tools/cache"
+)
+
+// A PodWeightCache records the contour.heptio.com/endpoint-weight annotation
+// of each pod. Its Weight method is suitable for EndpointsTranslator.PodWeight.
+type PodWeightCache struct {
+	logrus.FieldLogger
+
+	// OnChange, if set, is called after the weight of the named pod
+	// changes, including when its annotation is added or removed. It is
+	// typically EndpointsTranslator.PodWeightChanged, so overrides take
+	// effect whichever of the pod and its Endpoints is seen first.
+	OnChange func(namespace, name string)
+
+	mu      sync.RWMutex
+	weights map[string]uint32 // namespace/name to weight
+}
+
+func (p *PodWeightCache) OnAdd(obj interface{}) {
+	switch obj := obj.(type) {
+	case *v1.Pod:
+		p.update(obj)
+	default:
+		p.Errorf("OnAdd unexpected type %T: %#v", obj, obj)
+	}
+}
+
+func (p *PodWeightCache) OnUpdate(oldObj, newObj interface{}) {
+	switch newObj := newObj.(type) {
+	case *v1.Pod:
+		p.update(newObj)
+	default:
+		p.Errorf("OnUpdate unexpected type %T: %#v", newObj, newObj)
+	}
+}
+
+func (p *PodWeightCache) OnDelete(obj interface{}) {
+	switch obj := obj.(type) {
+	case *v1.Pod:
+		p.set(obj.Namespace, obj.Name, nil)
+	case _cache.DeletedFinalStateUnknown:
+		p.OnDelete(obj.Obj) // recurse into ourselves with the tombstoned value
+	default:
+		p.Errorf("OnDelete unexpected type %T: %#v", obj, obj)
+	}
+}
+
+// Weight returns the endpoint weight annotated on the named pod, and whether
+// the pod carries a valid annotation.
+func (p *PodWeightCache) Weight(namespace, name string) (uint32, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	w, ok := p.weights[namespace+"/"+name]
+	return w, ok
+}
+
+// update records pod's endpoint weight annotation, or forgets the pod if
+// the annotation is absent or malformed.
+func (p *PodWeightCache) update(pod *v1.Pod) {
+	w := parseAnnotationUInt32(pod.Annotations, annotationEndpointWeight)
+	if w == nil {
+		if v, ok := pod.Annotations[annotationEndpointWeight]; ok {
+			p.Warnf("pod %q: ignoring invalid %s annotation %q", pod.Namespace+"/"+pod.Name, annotationEndpointWeight, v)
+		}
+	}
+	p.set(pod.Namespace, pod.Name, w)
+}
+
+// set records w as the weight of the named pod, or forgets the pod if w
+// is nil, then calls OnChange if the recorded weight changed.
+func (p *PodWeightCache) set(namespace, name string, w *types.UInt32Value) {
+	key := namespace + "/" + name
+
+	p.mu.Lock()
+	prev, had := p.weights[key]
+	switch {
+	case w == nil:
+		delete(p.weights, key)
+	case p.weights == nil:
+		p.weights = map[string]uint32{key: w.Value}
+	default:
+		p.weights[key] = w.Value
+	}
+	p.mu.Unlock()
+
+	changed := had != (w != nil) || (w != nil && prev != w.Value)
+	if changed && p.OnChange != nil {
+		p.OnChange(namespace, name)
+	}
+}
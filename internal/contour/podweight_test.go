@@ -0,0 +1,181 @@
+// Copyright © 2018 Heptio
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package contour
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/gogo/protobuf/proto"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	_cache "k8s.io/client-go/tools/cache"
+)
+
+func TestPodWeightCache(t *testing.T) {
+	pod := func(name, weight string) *v1.Pod {
+		p := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      name,
+			},
+		}
+		if weight != "" {
+			p.Annotations = map[string]string{annotationEndpointWeight: weight}
+		}
+		return p
+	}
+
+	log, buf := bufferLogger()
+	pc := &PodWeightCache{FieldLogger: log}
+
+	pc.OnAdd(pod("a", "7"))
+	pc.OnAdd(pod("b", ""))
+	pc.OnAdd(pod("c", "heavy"))
+
+	assertWeight := func(name string, want uint32, wantok bool) {
+		t.Helper()
+		got, ok := pc.Weight("default", name)
+		if got != want || ok != wantok {
+			t.Fatalf("Weight(%q): got (%d, %v), want (%d, %v)", name, got, ok, want, wantok)
+		}
+	}
+
+	assertWeight("a", 7, true)
+	assertWeight("b", 0, false)
+	assertWeight("c", 0, false)
+	if !strings.Contains(buf.String(), `ignoring invalid contour.heptio.com/endpoint-weight annotation \"heavy\"`) {
+		t.Fatalf("expected invalid annotation warning, got: %q", buf.String())
+	}
+
+	pc.OnUpdate(pod("a", "7"), pod("a", "9"))
+	assertWeight("a", 9, true)
+
+	pc.OnUpdate(pod("a", "9"), pod("a", ""))
+	assertWeight("a", 0, false)
+
+	pc.OnAdd(pod("d", "3"))
+	pc.OnDelete(_cache.DeletedFinalStateUnknown{Obj: pod("d", "3")})
+	assertWeight("d", 0, false)
+
+	// the cache plugs straight into the translator.
+	et := &EndpointsTranslator{
+		FieldLogger: log,
+		PodWeight:   pc.Weight,
+	}
+	pc.OnAdd(pod("e", "5"))
+	ep := endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{{
+			IP:        "192.168.183.24",
+			TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "e"},
+		}},
+		Ports: ports(8080),
+	})
+	cla := et.LoadAssignment(ep, "")
+	if got := cla.Endpoints[0].LbEndpoints[0].LoadBalancingWeight.GetValue(); got != 5 {
+		t.Fatalf("expected weight 5, got %d", got)
+	}
+}
+
+func TestPodWeightCacheOnChange(t *testing.T) {
+	var changes []string
+	pc := &PodWeightCache{
+		FieldLogger: testLogger(t),
+		OnChange: func(namespace, name string) {
+			changes = append(changes, namespace+"/"+name)
+		},
+	}
+	pod := func(weight string) *v1.Pod {
+		p := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "default",
+				Name:      "simple-1",
+			},
+		}
+		if weight != "" {
+			p.Annotations = map[string]string{annotationEndpointWeight: weight}
+		}
+		return p
+	}
+
+	pc.OnAdd(pod(""))               // no weight, no change
+	pc.OnUpdate(pod(""), pod("4"))  // added
+	pc.OnUpdate(pod("4"), pod("4")) // resync, no change
+	pc.OnUpdate(pod("4"), pod("6")) // changed
+	pc.OnUpdate(pod("6"), pod(""))  // removed
+	pc.OnDelete(pod(""))            // already had no weight
+
+	want := []string{"default/simple-1", "default/simple-1", "default/simple-1"}
+	if !reflect.DeepEqual(want, changes) {
+		t.Fatalf("expected: %v, got: %v", want, changes)
+	}
+}
+
+func TestPodWeightCacheEndpointsFirst(t *testing.T) {
+	et := &EndpointsTranslator{
+		FieldLogger: testLogger(t),
+	}
+	pc := &PodWeightCache{
+		FieldLogger: testLogger(t),
+		OnChange:    et.PodWeightChanged,
+	}
+	et.PodWeight = pc.Weight
+
+	// the Endpoints object is seen before the pod that backs it.
+	et.OnAdd(endpoints("default", "simple", v1.EndpointSubset{
+		Addresses: []v1.EndpointAddress{{
+			IP:        "192.168.183.24",
+			TargetRef: &v1.ObjectReference{Kind: "Pod", Namespace: "default", Name: "simple-1"},
+		}, {
+			IP: "192.168.183.25",
+		}},
+		Ports: ports(8080),
+	}))
+
+	annotated := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Namespace:   "default",
+			Name:        "simple-1",
+			Annotations: map[string]string{annotationEndpointWeight: "5"},
+		},
+	}
+	pc.OnAdd(annotated)
+
+	want := []proto.Message{
+		clusterloadassignment("default/simple",
+			weightedlbendpoint("192.168.183.24", 8080, 5),
+			lbendpoint("192.168.183.25", 8080),
+		),
+	}
+	if got := contents(et); !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+	}
+
+	// removing the annotation restores the default weight.
+	pc.OnUpdate(annotated, &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+		Namespace: "default",
+		Name:      "simple-1",
+	}})
+
+	want = []proto.Message{
+		clusterloadassignment("default/simple",
+			lbendpoint("192.168.183.24", 8080),
+			lbendpoint("192.168.183.25", 8080),
+		),
+	}
+	if got := contents(et); !reflect.DeepEqual(want, got) {
+		t.Fatalf("expected:\n%v\ngot:\n%v", want, got)
+	}
+}
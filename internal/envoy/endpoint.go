@@ -0,0 +1,92 @@
+// Copyright © 2018 Heptio
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envoy
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+)
+
+// FormatClusterLoadAssignment returns a stable, human readable representation
+// of cla, one line per locality and endpoint. Localities are ordered by
+// priority then region, zone, and subzone; endpoints within a locality are
+// ordered by address. An endpoint without an explicit weight is shown with
+// Envoy's default weight of 1. The output is intended for golden tests of
+// EDS output, not for consumption by Envoy.
+func FormatClusterLoadAssignment(cla *v2.ClusterLoadAssignment) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "cluster %s\n", cla.ClusterName)
+
+	localities := make([]endpoint.LocalityLbEndpoints, len(cla.Endpoints))
+	copy(localities, cla.Endpoints)
+	sort.SliceStable(localities, func(i, j int) bool {
+		if localities[i].Priority != localities[j].Priority {
+			return localities[i].Priority < localities[j].Priority
+		}
+		return localityname(localities[i].Locality) < localityname(localities[j].Locality)
+	})
+
+	for _, l := range localities {
+		fmt.Fprintf(&buf, "  locality %q priority=%d", localityname(l.Locality), l.Priority)
+		if l.LoadBalancingWeight != nil {
+			fmt.Fprintf(&buf, " weight=%d", l.LoadBalancingWeight.Value)
+		}
+		buf.WriteByte('\n')
+
+		lbendpoints := make([]endpoint.LbEndpoint, len(l.LbEndpoints))
+		copy(lbendpoints, l.LbEndpoints)
+		sort.SliceStable(lbendpoints, func(i, j int) bool {
+			return EndpointAddress(lbendpoints[i]) < EndpointAddress(lbendpoints[j])
+		})
+
+		for _, lb := range lbendpoints {
+			weight := uint32(1)
+			if lb.LoadBalancingWeight != nil {
+				weight = lb.LoadBalancingWeight.Value
+			}
+			fmt.Fprintf(&buf, "    %s weight=%d", EndpointAddress(lb), weight)
+			if lb.HealthStatus != core.HealthStatus_UNKNOWN {
+				fmt.Fprintf(&buf, " health=%s", lb.HealthStatus)
+			}
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.String()
+}
+
+// localityname returns the region/zone/subzone of l, or the empty
+// string if l is nil.
+func localityname(l *core.Locality) string {
+	if l == nil {
+		return ""
+	}
+	return l.Region + "/" + l.Zone + "/" + l.SubZone
+}
+
+// EndpointAddress returns the host:port of lb's socket address, bracketing
+// IPv6 hosts.
+func EndpointAddress(lb endpoint.LbEndpoint) string {
+	if lb.Endpoint == nil {
+		return ""
+	}
+	sa := lb.Endpoint.Address.GetSocketAddress()
+	return net.JoinHostPort(sa.GetAddress(), strconv.Itoa(int(sa.GetPortValue())))
+}
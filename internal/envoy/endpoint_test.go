@@ -0,0 +1,117 @@
+// Copyright © 2018 Heptio
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package envoy
+
+import (
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/gogo/protobuf/types"
+)
+
+func TestFormatClusterLoadAssignment(t *testing.T) {
+	tests := map[string]struct {
+		cla  *v2.ClusterLoadAssignment
+		want string
+	}{
+		"empty": {
+			cla: &v2.ClusterLoadAssignment{
+				ClusterName: "default/empty",
+			},
+			want: "cluster default/empty\n",
+		},
+		"endpoints sorted by address": {
+			cla: &v2.ClusterLoadAssignment{
+				ClusterName: "default/simple",
+				Endpoints: []endpoint.LocalityLbEndpoints{{
+					LbEndpoints: []endpoint.LbEndpoint{
+						lbendpoint("192.168.183.25", 8080, 0),
+						lbendpoint("192.168.183.24", 8080, 5),
+					},
+				}},
+			},
+			want: `cluster default/simple
+  locality "" priority=0
+    192.168.183.24:8080 weight=5
+    192.168.183.25:8080 weight=1
+`,
+		},
+		"localities sorted by priority then name": {
+			cla: &v2.ClusterLoadAssignment{
+				ClusterName: "default/zoned",
+				Endpoints: []endpoint.LocalityLbEndpoints{{
+					Locality:            &core.Locality{Region: "us-east-1", Zone: "us-east-1b"},
+					LoadBalancingWeight: &types.UInt32Value{Value: 20},
+					LbEndpoints: []endpoint.LbEndpoint{
+						lbendpoint("10.0.0.2", 80, 0),
+					},
+				}, {
+					Locality: &core.Locality{Region: "us-east-1", Zone: "us-east-1c"},
+					Priority: 1,
+					LbEndpoints: []endpoint.LbEndpoint{
+						lbendpoint("10.0.0.3", 80, 0),
+					},
+				}, {
+					Locality:            &core.Locality{Region: "us-east-1", Zone: "us-east-1a"},
+					LoadBalancingWeight: &types.UInt32Value{Value: 10},
+					LbEndpoints: []endpoint.LbEndpoint{{
+						Endpoint:     lbendpoint("10.0.0.1", 80, 0).Endpoint,
+						HealthStatus: core.HealthStatus_DRAINING,
+					}},
+				}},
+			},
+			want: `cluster default/zoned
+  locality "us-east-1/us-east-1a/" priority=0 weight=10
+    10.0.0.1:80 weight=1 health=DRAINING
+  locality "us-east-1/us-east-1b/" priority=0 weight=20
+    10.0.0.2:80 weight=1
+  locality "us-east-1/us-east-1c/" priority=1
+    10.0.0.3:80 weight=1
+`,
+		},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			got := FormatClusterLoadAssignment(tc.cla)
+			if tc.want != got {
+				t.Fatalf("expected:\n%s\ngot:\n%s", tc.want, got)
+			}
+		})
+	}
+}
+
+func lbendpoint(addr string, port, weight uint32) endpoint.LbEndpoint {
+	lb := endpoint.LbEndpoint{
+		Endpoint: &endpoint.Endpoint{
+			Address: &core.Address{
+				Address: &core.Address_SocketAddress{
+					SocketAddress: &core.SocketAddress{
+						Protocol: core.TCP,
+						Address:  addr,
+						PortSpecifier: &core.SocketAddress_PortValue{
+							PortValue: port,
+						},
+					},
+				},
+			},
+		},
+	}
+	if weight > 0 {
+		lb.LoadBalancingWeight = &types.UInt32Value{Value: weight}
+	}
+	return lb
+}
@@ -40,6 +40,11 @@ func WatchEndpoints(g *workgroup.Group, client *kubernetes.Clientset, log logrus
 	watch(g, client.CoreV1().RESTClient(), log, "endpoints", new(v1.Endpoints), rs...)
 }
 
+// WatchPods creates a SharedInformer for v1.Pods and registers it with g.
+func WatchPods(g *workgroup.Group, client *kubernetes.Clientset, log logrus.FieldLogger, rs ...cache.ResourceEventHandler) {
+	watch(g, client.CoreV1().RESTClient(), log, "pods", new(v1.Pod), rs...)
+}
+
 // WatchIngress creates a SharedInformer for v1beta1.Ingress and registers it with g.
 func WatchIngress(g *workgroup.Group, client *kubernetes.Clientset, log logrus.FieldLogger, rs ...cache.ResourceEventHandler) {
 	watch(g, client.ExtensionsV1beta1().RESTClient(), log, "ingresses", new(v1beta1.Ingress), rs...)